@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// mailReceiverConfig holds the settings needed to run gh2mg against a plain
+// IMAP/SMTP mailbox instead of Mailgun.
+type mailReceiverConfig struct {
+	ImapHost    string
+	ImapUser    string
+	ImapPass    string
+	ImapMailbox string
+
+	SmtpHost string
+	SmtpUser string
+	SmtpPass string
+	SmtpFrom string
+}
+
+const imapReconnectBackoff = 5 * time.Second
+const imapMaxBackoff = 5 * time.Minute
+
+// seenMessageKey namespaces Message-ID dedup entries in rkv so they don't
+// collide with the mailgun-id -> issue# keys used elsewhere.
+func seenMessageKey(messageID string) string {
+	return "imap-seen:" + messageID
+}
+
+// runMailReceiver connects to the configured IMAP mailbox and watches it,
+// feeding any new messages to emailToComment. It never returns; on any
+// connection error it reconnects with an increasing backoff, resetting the
+// backoff once a connection stays up long enough to be considered healthy.
+func runMailReceiver(cfg mailReceiverConfig) {
+	backoff := imapReconnectBackoff
+	for {
+		connectedAt := time.Now()
+		err := watchMailbox(cfg)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("IMAP connection dropped, reconnecting")
+		}
+
+		if time.Since(connectedAt) > imapMaxBackoff {
+			backoff = imapReconnectBackoff
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > imapMaxBackoff {
+			backoff = imapMaxBackoff
+		}
+	}
+}
+
+// watchMailbox opens a single IMAP session, selects the configured mailbox,
+// fetches anything unseen, and then IDLEs until the server reports new mail
+// or the IDLE itself fails. A returned error always means the caller should
+// reconnect from scratch.
+func watchMailbox(cfg mailReceiverConfig) error {
+	c, err := client.DialTLS(cfg.ImapHost, nil)
+	if err != nil {
+		return fmt.Errorf("dial: %w", err)
+	}
+	defer c.Logout()
+
+	if err := c.Login(cfg.ImapUser, cfg.ImapPass); err != nil {
+		return fmt.Errorf("login: %w", err)
+	}
+
+	mbox, err := c.Select(cfg.ImapMailbox, false)
+	if err != nil {
+		return fmt.Errorf("select %q: %w", cfg.ImapMailbox, err)
+	}
+
+	if err := fetchUnseen(c, mbox); err != nil {
+		return fmt.Errorf("initial fetch: %w", err)
+	}
+
+	updates := make(chan client.Update, 1)
+	c.Updates = updates
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Idle(stop, nil)
+	}()
+
+	for {
+		select {
+		case update := <-updates:
+			if _, ok := update.(*client.MailboxUpdate); ok {
+				close(stop)
+				<-done
+				return fetchUnseen(c, mbox)
+			}
+		case err := <-done:
+			return err
+		}
+	}
+}
+
+// fetchUnseen pulls every unread message out of the selected mailbox,
+// converts each into a GitHub comment, and marks it seen once handled so a
+// reconnect does not reprocess it.
+func fetchUnseen(c *client.Client, mbox *imap.MailboxStatus) error {
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	ids, err := c.Search(criteria)
+	if err != nil {
+		return fmt.Errorf("search: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(ids...)
+
+	// BODY.PEEK[] leaves \Seen alone, so a message that fails to process
+	// stays unseen; only handled messages are flagged below.
+	section := &imap.BodySectionName{Peek: true}
+	items := []imap.FetchItem{section.FetchItem()}
+
+	messages := make(chan *imap.Message, len(ids))
+	fetchErr := make(chan error, 1)
+	go func() {
+		fetchErr <- c.Fetch(seqset, items, messages)
+	}()
+
+	handled := new(imap.SeqSet)
+	for msg := range messages {
+		body := msg.GetBody(section)
+		if body == nil {
+			continue
+		}
+		if err := handleIncomingMail(body); err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("failed to process incoming mail, leaving it unseen for retry")
+			continue
+		}
+		handled.AddNum(msg.SeqNum)
+	}
+
+	if err := <-fetchErr; err != nil {
+		return fmt.Errorf("fetch: %w", err)
+	}
+
+	if handled.Empty() {
+		return nil
+	}
+
+	return c.Store(handled, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.SeenFlag}, nil)
+}
+
+// handleIncomingMail parses a raw RFC 5322 message read from IMAP, extracts
+// the fields emailToComment needs, and dedupes on Message-ID via rkv so a
+// redelivered message does not double-post a GitHub comment.
+func handleIncomingMail(r io.Reader) error {
+	m, err := mail.ReadMessage(r)
+	if err != nil {
+		return fmt.Errorf("parse message: %w", err)
+	}
+
+	messageID := strings.TrimSpace(m.Header.Get("Message-Id"))
+	if messageID != "" {
+		var seen bool
+		if err := kv.Get(seenMessageKey(messageID), &seen); err == nil && seen {
+			log.WithFields(log.Fields{
+				"message_id": messageID,
+			}).Info("skipping already-processed message")
+			return nil
+		}
+	}
+
+	from := m.Header.Get("From")
+	to := m.Header.Get("To")
+	deliveredTo := m.Header.Get("Delivered-To")
+	references := strings.TrimSpace(m.Header.Get("References"))
+	inReplyTo := strings.TrimSpace(m.Header.Get("In-Reply-To"))
+	if inReplyTo == "" {
+		// Some clients drop In-Reply-To on later replies in a thread but
+		// keep appending to References; the last id there is our target.
+		fields := strings.Fields(references)
+		if len(fields) > 0 {
+			inReplyTo = fields[len(fields)-1]
+		}
+	}
+
+	body, err := readPlainTextBody(m)
+	if err != nil {
+		return fmt.Errorf("read body: %w", err)
+	}
+
+	cleaned := stripPlainTextReply(body)
+	emailToComment(wrapWithOriginal(from, cleaned, body), to, deliveredTo, references, inReplyTo)
+
+	if messageID != "" {
+		seen := true
+		kv.Put(seenMessageKey(messageID), &seen)
+	}
+
+	return nil
+}
+
+// readPlainTextBody returns the best available text representation of a
+// message: the first text/plain part for a multipart message (e.g. the
+// multipart/alternative that Gmail, Outlook and Apple Mail all send),
+// falling back to the first text/html part converted to markdown, and
+// finally the raw body for a non-multipart message. Per-part
+// Content-Transfer-Encoding (quoted-printable or base64) is decoded before
+// the part's bytes are used.
+func readPlainTextBody(m *mail.Message) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return decodePartBody(m.Header.Get("Content-Transfer-Encoding"), m.Body)
+	}
+
+	plainText, htmlText, err := findMultipartText(m.Body, params["boundary"])
+	if err != nil {
+		return "", err
+	}
+	if plainText != "" {
+		return plainText, nil
+	}
+	if htmlText != "" {
+		return htmlToCleanedMarkdown(htmlText)
+	}
+	return "", nil
+}
+
+// findMultipartText walks a (possibly nested, e.g. multipart/mixed wrapping
+// a multipart/alternative) MIME tree looking for the first text/plain part,
+// remembering the first text/html part as a fallback in case no plain part
+// exists.
+func findMultipartText(r io.Reader, boundary string) (plainText, htmlText string, err error) {
+	if boundary == "" {
+		return "", "", fmt.Errorf("multipart message missing boundary")
+	}
+
+	mr := multipart.NewReader(r, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", "", fmt.Errorf("read multipart part: %w", err)
+		}
+
+		partType, partParams, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			partType = "text/plain"
+		}
+
+		if strings.HasPrefix(partType, "multipart/") {
+			nestedPlain, nestedHTML, err := findMultipartText(part, partParams["boundary"])
+			if err != nil {
+				return "", "", err
+			}
+			if plainText == "" {
+				plainText = nestedPlain
+			}
+			if htmlText == "" {
+				htmlText = nestedHTML
+			}
+			continue
+		}
+
+		body, err := decodePartBody(part.Header.Get("Content-Transfer-Encoding"), part)
+		if err != nil {
+			return "", "", fmt.Errorf("decode part body: %w", err)
+		}
+
+		switch {
+		case partType == "text/plain" && plainText == "":
+			plainText = body
+		case partType == "text/html" && htmlText == "":
+			htmlText = body
+		}
+	}
+
+	return plainText, htmlText, nil
+}
+
+// decodePartBody reads r fully, undoing quoted-printable or base64
+// Content-Transfer-Encoding if present.
+func decodePartBody(transferEncoding string, r io.Reader) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(transferEncoding)) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+
+	raw, err := ioutil.ReadAll(r)
+	return string(raw), err
+}
+
+// sendMail delivers an outbound reply over plain SMTP, used in place of
+// mailgun.Send when gh2mg is running with --transport imap+smtp.
+func sendMail(cfg mailReceiverConfig, to, subject, body, replyTo string) error {
+	auth := smtp.PlainAuth("", cfg.SmtpUser, cfg.SmtpPass, strings.Split(cfg.SmtpHost, ":")[0])
+
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nReply-To: %s\r\nSubject: %s\r\n\r\n%s",
+		stripHeaderInjection(cfg.SmtpFrom), stripHeaderInjection(to), stripHeaderInjection(replyTo),
+		stripHeaderInjection(subject), body)
+
+	return smtp.SendMail(cfg.SmtpHost, auth, cfg.SmtpFrom, []string{to}, []byte(msg))
+}
+
+// stripHeaderInjection removes CR/LF from a value headed for a raw SMTP
+// header line (e.g. a GitHub issue title used as the Subject), so it can't
+// be used to smuggle extra headers like Bcc into the outgoing message.
+func stripHeaderInjection(value string) string {
+	value = strings.ReplaceAll(value, "\r", "")
+	value = strings.ReplaceAll(value, "\n", "")
+	return value
+}
@@ -50,14 +50,25 @@ type payload struct {
 }
 
 var (
-	version   string
-	builddate string
-	gh_cache  *cache.Cache
-	gh_client *github.Client
-	ctx       context.Context
-	mg        mailgun.Mailgun
-	dryrun    bool
-	kv        *rkv.Rkv
+	version            string
+	builddate          string
+	gh_cache           *cache.Cache
+	gh_client          *github.Client
+	ctx                context.Context
+	mg                 mailgun.Mailgun
+	dryrun             bool
+	kv                 *rkv.Rkv
+	transport          string
+	mailCfg            mailReceiverConfig
+	mgDomain           string
+	replyDomain        string
+	replySecret        string
+	routes             []Route
+	mgKey              string
+	ghWebhookSecret    string
+	webhookReplySecret string
+	mgReplayCache      *cache.Cache
+	notifiers          []Notifier
 )
 
 func main() {
@@ -105,6 +116,82 @@ func main() {
 			Usage:  "Enables GDPR Compliance mode which translates pseudonyms and templated variables into their real values before emailing",
 			EnvVar: "GDPR_COMPLIANCE_MODE",
 		},
+		cli.StringFlag{
+			Name:   "transport",
+			Value:  "mailgun",
+			Usage:  "Mail transport to use: \"mailgun\" (webhooks) or \"imap+smtp\"",
+			EnvVar: "TRANSPORT",
+		},
+		cli.StringFlag{
+			Name:   "imap_host",
+			Usage:  "IMAP server address (host:port) to receive replies from",
+			EnvVar: "IMAP_HOST",
+		},
+		cli.StringFlag{
+			Name:   "imap_user",
+			EnvVar: "IMAP_USER",
+		},
+		cli.StringFlag{
+			Name:   "imap_pass",
+			EnvVar: "IMAP_PASS",
+		},
+		cli.StringFlag{
+			Name:   "imap_mailbox",
+			Value:  "INBOX",
+			EnvVar: "IMAP_MAILBOX",
+		},
+		cli.StringFlag{
+			Name:   "smtp_host",
+			Usage:  "SMTP server address (host:port) to send replies through",
+			EnvVar: "SMTP_HOST",
+		},
+		cli.StringFlag{
+			Name:   "smtp_user",
+			EnvVar: "SMTP_USER",
+		},
+		cli.StringFlag{
+			Name:   "smtp_pass",
+			EnvVar: "SMTP_PASS",
+		},
+		cli.StringFlag{
+			Name:   "smtp_from",
+			EnvVar: "SMTP_FROM",
+		},
+		cli.StringFlag{
+			Name:   "reply-secret",
+			Usage:  "Secret used to HMAC-sign the Reply-To token embedded in outgoing mail",
+			EnvVar: "REPLY_SECRET",
+		},
+		cli.StringFlag{
+			Name:   "reply-domain",
+			Usage:  "Domain embedded in signed Reply-To tokens; defaults to mg_domain, or to the domain of smtp_from under --transport imap+smtp",
+			EnvVar: "REPLY_DOMAIN",
+		},
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "Path to a YAML file declaring routes from addresses/repos to GitHub owner/repo",
+			EnvVar: "CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "gh-webhook-secret",
+			Usage:  "Secret configured on the GitHub webhook, used to verify X-Hub-Signature-256",
+			EnvVar: "GH_WEBHOOK_SECRET",
+		},
+		cli.StringFlag{
+			Name:   "slack-webhook-url",
+			Usage:  "Slack incoming webhook URL to notify of new issue comments",
+			EnvVar: "SLACK_WEBHOOK_URL",
+		},
+		cli.StringFlag{
+			Name:   "notify-webhook-url",
+			Usage:  "Generic outbound webhook URL to notify of new issue comments",
+			EnvVar: "NOTIFY_WEBHOOK_URL",
+		},
+		cli.StringFlag{
+			Name:   "webhook-reply-secret",
+			Usage:  "Secret used to verify X-Webhook-Signature-256 on inbound /webhook/reply callbacks",
+			EnvVar: "WEBHOOK_REPLY_SECRET",
+		},
 	}
 
 	app.Action = func(c *cli.Context) {
@@ -144,11 +231,77 @@ func main() {
 			c.String("mg_pubkey"),
 		)
 
+		mgDomain = c.String("mg_domain")
+		mgKey = c.String("mg_key")
+		replySecret = c.String("reply-secret")
+		ghWebhookSecret = c.String("gh-webhook-secret")
+		if ghWebhookSecret == "" {
+			log.Fatal("--gh-webhook-secret is required to verify inbound GitHub webhooks")
+		}
+		webhookReplySecret = c.String("webhook-reply-secret")
+		mgReplayCache = cache.New(mailgunReplayTTL, mailgunReplayTTL)
+
+		var routesErr error
+		routes, routesErr = loadRoutes(c.String("config"))
+		if routesErr != nil {
+			log.Fatal(routesErr)
+		}
+
+		transport = c.String("transport")
+
+		notifiers = nil
+		if transport == "imap+smtp" {
+			notifiers = append(notifiers, SMTPNotifier{})
+		} else {
+			notifiers = append(notifiers, MailgunNotifier{})
+		}
+		if url := c.String("slack-webhook-url"); url != "" {
+			notifiers = append(notifiers, SlackNotifier{WebhookURL: url})
+		}
+		if url := c.String("notify-webhook-url"); url != "" {
+			notifiers = append(notifiers, WebhookNotifier{URL: url})
+		}
+
+		mailCfg = mailReceiverConfig{
+			ImapHost:    c.String("imap_host"),
+			ImapUser:    c.String("imap_user"),
+			ImapPass:    c.String("imap_pass"),
+			ImapMailbox: c.String("imap_mailbox"),
+			SmtpHost:    c.String("smtp_host"),
+			SmtpUser:    c.String("smtp_user"),
+			SmtpPass:    c.String("smtp_pass"),
+			SmtpFrom:    c.String("smtp_from"),
+		}
+
+		replyDomain = c.String("reply-domain")
+		if replyDomain == "" {
+			if transport == "imap+smtp" {
+				replyDomain = domainOf(mailCfg.SmtpFrom)
+			} else {
+				replyDomain = mgDomain
+			}
+		}
+
 		http.Handle("/github", http.HandlerFunc(githubWebHook))
-		http.Handle("/mailgun", http.HandlerFunc(mailgunWebHook))
+
+		if c.String("notify-webhook-url") != "" {
+			if webhookReplySecret == "" {
+				log.Fatal("--webhook-reply-secret is required when --notify-webhook-url is set")
+			}
+			http.Handle("/webhook/reply", http.HandlerFunc(webhookReplyHook))
+			log.Printf("listening for webhook replies on: %s/webhook/reply", c.String("listen"))
+		}
+
+		switch transport {
+		case "imap+smtp":
+			log.Printf("receiving replies over IMAP from: %s", mailCfg.ImapHost)
+			go runMailReceiver(mailCfg)
+		default:
+			http.Handle("/mailgun", http.HandlerFunc(mailgunWebHook))
+			log.Printf("listening for mailgun webhooks on: %s/mailgun", c.String("listen"))
+		}
 
 		log.Printf("listening for github  webhooks on: %s/github", c.String("listen"))
-		log.Printf("listening for mailgun webhooks on: %s/mailgun", c.String("listen"))
 		log.Fatal(http.ListenAndServe(c.String("listen"), nil))
 
 	}
@@ -196,83 +349,109 @@ func extractEmailFromIssue(body string) (email string) {
 	return email
 }
 
-func commentToEmail(author, title, comment, reply_to string) (messageID string) {
-	log.WithFields(log.Fields{
-		"author":   author,
-		"title":    title,
-		"reply_to": reply_to,
-		"dry":      dryrun,
-	}).Info("EMail Hanlder")
-
-	if dryrun {
+// firstOrEmpty returns the first element of a form value slice, or "" if
+// the field was not present in the request.
+func firstOrEmpty(values []string) string {
+	if len(values) == 0 {
 		return ""
 	}
+	return values[0]
+}
 
-	message := mg.NewMessage(
-		author+" <bugs@usegalaxy.eu>",
-		"Re: "+title,
-		comment,
-		reply_to,
-	)
-	resp, id, err := mg.Send(message)
+// postIssueComment creates the actual GitHub comment once a channel (email,
+// Slack, a generic webhook, ...) has resolved which issue a reply belongs
+// to. Every Receiver funnels into this one place.
+func postIssueComment(owner, repo string, issueNum int, comment string) error {
+	issue, _, err := gh_client.Issues.Get(ctx, owner, repo, issueNum)
 	if err != nil {
-		log.Fatal(err)
+		log.Error(err)
+	}
+	fmt.Println(issue, err)
 
+	if dryrun {
+		return nil
 	}
 
-	log.WithFields(log.Fields{
-		"id":   id,
-		"resp": resp,
-	}).Info("Mailgun")
-	return id
+	c := &github.IssueComment{
+		Body: &comment,
+	}
+	_, _, err = gh_client.Issues.CreateComment(ctx, owner, repo, issueNum, c)
+	return err
 }
 
-func emailToComment(comment, in_reply_to string) {
+// emailToComment routes an inbound mail to a GitHub comment. It first tries
+// to recover the target owner/repo/issue from a signed reply token found in
+// the To/Delivered-To header, or failing that in References; rkv is only
+// consulted as a migration fallback for mail sent before tokens existed.
+func emailToComment(comment, to, deliveredTo, references, in_reply_to string) {
 	log.WithFields(log.Fields{
 		"in_reply_to": in_reply_to,
 		"dry":         dryrun,
 	}).Info("Comment Hanlder")
 
-	var issueNum int
-
-	arr := kv.GetKeys("", -1)
-	for _, key := range arr {
-		var v int //v := Mytype{}
-		err := kv.Get(key, &v)
-		if err != nil {
-			log.Fatal("Error while iterating %q", err.Error())
-
-		}
-		fmt.Println(key, v)
-
+	owner, repo, issueNum, err := resolveReplyTarget(to, deliveredTo, references, in_reply_to)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("could not determine which issue this reply belongs to")
+		return
 	}
-	//err := kv.Get(in_reply_to, issueNum)
-	//if err != nil {
-	//log.Error(err)
-	//}
-	issueNum = 1
 
-	//fmt.Println(issueNum, err)
-	// get a ref to the issue object
-	issue, _, err := gh_client.Issues.Get(ctx, "usegalaxy.eu", "issues", issueNum)
-	if err != nil {
+	if err := postIssueComment(owner, repo, issueNum, comment); err != nil {
 		log.Error(err)
 	}
-	fmt.Println(issue, err)
+}
 
-	if dryrun {
+// receiverToComment is the non-email counterpart of emailToComment: any
+// Receiver (Slack, a generic webhook, ...) resolves its channel-specific
+// ref to an issue and the comment is posted the same way.
+func receiverToComment(receiver Receiver, ref, comment string) {
+	owner, repo, issueNum, err := receiver.Resolve(ref)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"notifier": receiver.Name(),
+			"error":    err.Error(),
+		}).Error("could not resolve which issue this reply belongs to")
 		return
 	}
 
-	c := &github.IssueComment{
-		Body: &comment,
-	}
-	_, _, err = gh_client.Issues.CreateComment(ctx, "usegalaxy.eu", "issue-testing", issueNum, c)
-	if err != nil {
+	if err := postIssueComment(owner, repo, issueNum, comment); err != nil {
 		log.Error(err)
 	}
+}
 
-	return
+// resolveReplyTarget extracts the owner/repo/issue a reply belongs to,
+// preferring the signed token and falling back to the legacy rkv
+// Message-ID lookup for mail that predates tokens.
+func resolveReplyTarget(to, deliveredTo, references, in_reply_to string) (owner, repo string, issueNum int, err error) {
+	if token, ok := extractReplyToken(to); ok {
+		return parseReplyToken(replySecret, token)
+	}
+	if token, ok := extractReplyToken(deliveredTo); ok {
+		return parseReplyToken(replySecret, token)
+	}
+	if token, ok := extractReplyTokenFromReferences(references, replyDomain); ok {
+		return parseReplyToken(replySecret, token)
+	}
+
+	if in_reply_to != "" {
+		var legacyIssueNum int
+		if err := kv.Get(in_reply_to, &legacyIssueNum); err == nil {
+			route, ok := routeForAddress(routes, to)
+			if !ok {
+				route, ok = routeForAddress(routes, deliveredTo)
+			}
+			if !ok && len(routes) > 0 {
+				route = routes[0]
+			}
+			if route.Owner == "" {
+				route.Owner, route.Repo = "usegalaxy.eu", "issues"
+			}
+			return route.Owner, route.Repo, legacyIssueNum, nil
+		}
+	}
+
+	return "", "", 0, fmt.Errorf("no reply token found and no legacy rkv match for %q", in_reply_to)
 }
 
 func mailgunWebHook(w http.ResponseWriter, req *http.Request) {
@@ -290,19 +469,45 @@ func mailgunWebHook(w http.ResponseWriter, req *http.Request) {
 	//return
 	//}
 
-	err := req.ParseForm()
-	if err != nil {
+	// Mailgun's inbound route forwards as multipart/form-data, not
+	// application/x-www-form-urlencoded, so ParseForm alone would leave
+	// PostForm empty; ParseMultipartForm parses both and populates PostForm
+	// either way.
+	if err := req.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	if !verifyMailgunSignature(
+		mgKey,
+		firstOrEmpty(req.PostForm["timestamp"]),
+		firstOrEmpty(req.PostForm["token"]),
+		firstOrEmpty(req.PostForm["signature"]),
+		mgReplayCache,
+	) {
+		rejectUnauthorized(req.RemoteAddr, "invalid or replayed mailgun signature")
+		http.Error(w, http.StatusText(401), 401)
+		return
+	}
+
 	//log.Println("r.PostForm", req.PostForm)
-	html_body, _ := req.PostForm["stripped-html"]
-	from, _ := req.PostForm["From"]
-	in_reply_to, _ := req.PostForm["In-Reply-To"]
+	from := firstOrEmpty(req.PostForm["From"])
+	to := firstOrEmpty(req.PostForm["To"])
+	delivered_to := firstOrEmpty(req.PostForm["Delivered-To"])
+	references := firstOrEmpty(req.PostForm["References"])
+	in_reply_to := firstOrEmpty(req.PostForm["In-Reply-To"])
+	stripped_text := firstOrEmpty(req.PostForm["stripped-text"])
+	stripped_html := firstOrEmpty(req.PostForm["stripped-html"])
+	body_plain := firstOrEmpty(req.PostForm["body-plain"])
+
+	cleaned := extractReplyBody(stripped_text, stripped_html, body_plain)
 
 	emailToComment(
-		from[0]+" wrote: \n\n"+html_body[0],
-		in_reply_to[0],
+		wrapWithOriginal(from, cleaned, body_plain),
+		to,
+		delivered_to,
+		references,
+		in_reply_to,
 	)
 
 	w.Write([]byte("OK"))
@@ -343,6 +548,12 @@ func githubWebHook(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if !verifyGitHubSignature(ghWebhookSecret, body, req.Header.Get("X-Hub-Signature-256")) {
+		rejectUnauthorized(req.RemoteAddr, "invalid X-Hub-Signature-256")
+		http.Error(w, http.StatusText(401), 401)
+		return
+	}
+
 	// read payload to struct
 	var comment payload
 	if err := json.Unmarshal(body, &comment); err != nil {
@@ -358,20 +569,73 @@ func githubWebHook(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// find hook based on repository
-	response := commentToEmail(
-		getNameForUser(comment.Comment.User.Login),
-		comment.Issue.Title,
-		comment.Comment.Body,
-		extractEmailFromIssue(comment.Issue.Body),
-	)
+	author := getNameForUser(comment.Comment.User.Login)
+	from := "bugs@usegalaxy.eu"
+	commentBody := comment.Comment.Body
+	if route, ok := routeForRepo(routes, comment.Repository.Owner.Login, comment.Repository.Name); ok {
+		from = route.From
+		commentBody = renderRouteTemplate(route, author, comment.Issue.Title, commentBody)
+	}
 
-	if !dryrun {
-		if response != "" {
-			kv.Put(response, &comment.Issue.Number)
-		} else {
-			log.Error("Response to message ID was nil but not dry-run")
-		}
+	event := NotifyEvent{
+		Owner:    comment.Repository.Owner.Login,
+		Repo:     comment.Repository.Name,
+		IssueNum: comment.Issue.Number,
+		Title:    comment.Issue.Title,
+		Author:   author,
+		Body:     commentBody,
+		ReplyTo:  extractEmailFromIssue(comment.Issue.Body),
+		From:     from,
+	}
+	notifyAll(ctx, notifiers, event)
+
+	w.Write([]byte("OK"))
+}
+
+// webhookReplyPayload is the body an outbound WebhookNotifier sink is
+// expected to call back with once it has a reply to post: the `ref` it
+// returned in its response when the original comment was pushed out, plus
+// the reply text.
+type webhookReplyPayload struct {
+	Ref     string `json:"ref"`
+	Comment string `json:"comment"`
+}
+
+// webhookReplyHook is the inbound half of WebhookNotifier: it lets a
+// generic outbound webhook sink route a reply back into GitHub by resolving
+// the ref it returned from the original WebhookNotifier post against rkv.
+func webhookReplyHook(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Error("failed to read request body:", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
 	}
 
+	if !verifyGitHubSignature(webhookReplySecret, body, req.Header.Get("X-Webhook-Signature-256")) {
+		rejectUnauthorized(req.RemoteAddr, "invalid X-Webhook-Signature-256")
+		http.Error(w, http.StatusText(401), 401)
+		return
+	}
+
+	var reply webhookReplyPayload
+	if err := json.Unmarshal(body, &reply); err != nil {
+		log.Error("failed to unmarshal webhook reply payload:", err)
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	if reply.Ref == "" {
+		http.Error(w, http.StatusText(400), 400)
+		return
+	}
+
+	receiverToComment(rkvReceiver{"webhook"}, reply.Ref, reply.Comment)
+
 	w.Write([]byte("OK"))
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// NotifyEvent carries everything a Notifier needs to announce a new GitHub
+// issue comment on its channel.
+type NotifyEvent struct {
+	Owner    string
+	Repo     string
+	IssueNum int
+	Title    string
+	Author   string
+	Body     string
+	ReplyTo  string // destination address, for email-like notifiers
+	From     string // sender identity, for email-like notifiers
+}
+
+// Notifier announces a GitHub comment on some external channel (email,
+// Slack, a generic webhook, ...) and returns an opaque reference that
+// identifies the posted message on that channel, so a later reply can be
+// routed back to the right issue.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, event NotifyEvent) (ref string, err error)
+}
+
+// Receiver is the inverse of Notifier: given the reference a Notifier
+// returned, it recovers which issue that message belongs to.
+type Receiver interface {
+	Name() string
+	Resolve(ref string) (owner, repo string, issueNum int, err error)
+}
+
+// issueRef is what gets stored in rkv against a "<notifier>:<ref>" key so
+// Receiver.Resolve can map a channel-specific reference back to an issue.
+type issueRef struct {
+	Owner    string
+	Repo     string
+	IssueNum int
+}
+
+func notifierKey(notifierName, ref string) string {
+	return notifierName + ":" + ref
+}
+
+// rememberNotification persists the (notifier, ref) -> issue mapping so a
+// reply arriving on that channel can be resolved back to the issue later.
+func rememberNotification(notifierName, ref string, event NotifyEvent) {
+	if ref == "" {
+		return
+	}
+	key := notifierKey(notifierName, ref)
+	kv.Put(key, &issueRef{Owner: event.Owner, Repo: event.Repo, IssueNum: event.IssueNum})
+}
+
+// rkvReceiver resolves references for any Notifier that persisted them via
+// rememberNotification; the generic webhook reply route uses it, while email
+// resolves itself via signed reply tokens instead of an rkv lookup.
+type rkvReceiver struct {
+	notifierName string
+}
+
+func (r rkvReceiver) Name() string { return r.notifierName }
+
+func (r rkvReceiver) Resolve(ref string) (owner, repo string, issueNum int, err error) {
+	var stored issueRef
+	if err := kv.Get(notifierKey(r.notifierName, ref), &stored); err != nil {
+		return "", "", 0, fmt.Errorf("no notification remembered for %s ref %q: %w", r.notifierName, ref, err)
+	}
+	return stored.Owner, stored.Repo, stored.IssueNum, nil
+}
+
+// notifyAll fans an event out to every configured notifier, logging and
+// remembering each reference so replies on that channel can find their way
+// back to the issue.
+func notifyAll(ctx context.Context, notifiers []Notifier, event NotifyEvent) {
+	for _, n := range notifiers {
+		ref, err := n.Notify(ctx, event)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"notifier": n.Name(),
+				"error":    err.Error(),
+			}).Error("notifier failed")
+			continue
+		}
+		rememberNotification(n.Name(), ref, event)
+	}
+}
+
+// MailgunNotifier sends the comment as an email through Mailgun, with a
+// signed Reply-To address so a reply can be routed back without any rkv
+// lookup.
+type MailgunNotifier struct{}
+
+func (MailgunNotifier) Name() string { return "mailgun" }
+
+func (MailgunNotifier) Notify(ctx context.Context, event NotifyEvent) (string, error) {
+	if dryrun {
+		return "", nil
+	}
+
+	replyTo := replyAddress(replySecret, replyDomain, event.Owner, event.Repo, event.IssueNum)
+
+	message := mg.NewMessage(
+		event.Author+" <"+event.From+">",
+		"Re: "+event.Title,
+		event.Body,
+		event.ReplyTo,
+	)
+	message.AddHeader("Reply-To", replyTo)
+
+	resp, id, err := mg.Send(message)
+	if err != nil {
+		return "", fmt.Errorf("mailgun send: %w", err)
+	}
+
+	log.WithFields(log.Fields{
+		"id":   id,
+		"resp": resp,
+	}).Info("Mailgun")
+	return id, nil
+}
+
+// SMTPNotifier sends the comment as an email over plain SMTP, used when
+// gh2mg is running with --transport imap+smtp instead of Mailgun.
+type SMTPNotifier struct{}
+
+func (SMTPNotifier) Name() string { return "smtp" }
+
+func (SMTPNotifier) Notify(ctx context.Context, event NotifyEvent) (string, error) {
+	if dryrun {
+		return "", nil
+	}
+
+	replyTo := replyAddress(replySecret, replyDomain, event.Owner, event.Repo, event.IssueNum)
+	if err := sendMail(mailCfg, event.ReplyTo, "Re: "+event.Title, event.Body, replyTo); err != nil {
+		return "", fmt.Errorf("smtp send: %w", err)
+	}
+	// The reply token in the Reply-To header is what routes the eventual
+	// reply back to this issue, so there's no separate ref to remember.
+	return "", nil
+}
+
+// SlackNotifier posts the comment to a Slack incoming webhook as a Block
+// Kit message showing the issue title, author and body. This is outbound
+// only: incoming webhooks don't hand back a message timestamp to thread
+// replies against, so routing a Slack thread reply back to an issue needs
+// a chat.postMessage-based notifier (bot token) and an Events API handler
+// instead; neither exists yet, so there is no inbound route for Slack.
+type SlackNotifier struct {
+	WebhookURL string
+}
+
+func (SlackNotifier) Name() string { return "slack" }
+
+func (s SlackNotifier) Notify(ctx context.Context, event NotifyEvent) (string, error) {
+	if dryrun || s.WebhookURL == "" {
+		return "", nil
+	}
+
+	issueLink := fmt.Sprintf("https://github.com/%s/%s/issues/%d", event.Owner, event.Repo, event.IssueNum)
+	payload := map[string]interface{}{
+		"blocks": []map[string]interface{}{
+			{
+				"type": "section",
+				"text": map[string]string{
+					"type": "mrkdwn",
+					"text": fmt.Sprintf("*<%s|%s>*\n%s", issueLink, event.Title, event.Body),
+				},
+			},
+			{
+				"type": "context",
+				"elements": []map[string]string{
+					{"type": "mrkdwn", "text": "Comment by " + event.Author},
+				},
+			},
+		},
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("marshal slack payload: %w", err)
+	}
+
+	resp, err := http.Post(s.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("post to slack: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("slack webhook returned %s", resp.Status)
+	}
+
+	// Incoming webhooks don't hand back a message timestamp to thread
+	// replies against, so there is no ref to remember here. Routing Slack
+	// thread replies back to an issue requires the Events API and a
+	// chat.postMessage-based notifier instead; this is left for when that
+	// bot integration exists.
+	return "", nil
+}
+
+// WebhookNotifier posts the comment as a generic JSON payload to an
+// arbitrary outbound URL, for external systems that don't have a
+// dedicated notifier.
+type WebhookNotifier struct {
+	URL string
+}
+
+func (WebhookNotifier) Name() string { return "webhook" }
+
+func (w WebhookNotifier) Notify(ctx context.Context, event NotifyEvent) (string, error) {
+	if dryrun || w.URL == "" {
+		return "", nil
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		return "", fmt.Errorf("marshal webhook payload: %w", err)
+	}
+
+	resp, err := http.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("post to webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	var decoded struct {
+		Ref string `json:"ref"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		// Not every webhook sink returns a ref; that's fine, it just means
+		// replies on this channel can't be routed back automatically.
+		return "", nil
+	}
+	return decoded.Ref, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Route maps one inbound/outbound address to a GitHub repository, so a
+// single gh2mg instance can front several projects instead of the
+// hard-coded usegalaxy.eu/issues repo.
+type Route struct {
+	Match    string   `yaml:"match"`
+	Owner    string   `yaml:"owner"`
+	Repo     string   `yaml:"repo"`
+	From     string   `yaml:"from"`
+	Labels   []string `yaml:"labels"`
+	Template string   `yaml:"template"`
+}
+
+type routeFile struct {
+	Routes []Route `yaml:"routes"`
+}
+
+// loadRoutes reads the routing config passed via --config. An empty path
+// is not an error: gh2mg then runs with zero routes and callers fall back
+// to their pre-routing defaults.
+func loadRoutes(path string) ([]Route, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read routes config %q: %w", path, err)
+	}
+
+	var f routeFile
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parse routes config %q: %w", path, err)
+	}
+
+	return f.Routes, nil
+}
+
+// routeForRepo finds the route declared for a GitHub owner/repo, used by
+// githubWebHook to pick the From address and body template for an outbound
+// reply. A route's Labels are parsed but not applied anywhere.
+func routeForRepo(routes []Route, owner, repo string) (Route, bool) {
+	for _, r := range routes {
+		if r.Owner == owner && r.Repo == repo {
+			return r, true
+		}
+	}
+	return Route{}, false
+}
+
+// routeForAddress finds the route whose match address corresponds to an
+// inbound recipient, used to pick the target repo for mail arriving
+// without a signed reply token.
+func routeForAddress(routes []Route, address string) (Route, bool) {
+	addr := bareAddress(address)
+	if addr == "" {
+		return Route{}, false
+	}
+	for _, r := range routes {
+		if strings.EqualFold(bareAddress(r.Match), addr) {
+			return r, true
+		}
+	}
+	return Route{}, false
+}
+
+// bareAddress extracts the plain "user@host" part out of a header value
+// that may be formatted as "Display Name <user@host>".
+func bareAddress(value string) string {
+	addr, err := mail.ParseAddress(value)
+	if err != nil {
+		return strings.TrimSpace(value)
+	}
+	return addr.Address
+}
+
+// renderRouteTemplate formats the outbound comment body through a route's
+// template, if it declares one, falling back to the raw comment text.
+func renderRouteTemplate(route Route, author, title, comment string) string {
+	if route.Template == "" {
+		return comment
+	}
+
+	tmpl, err := template.New("route").Parse(route.Template)
+	if err != nil {
+		return comment
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, struct {
+		Author  string
+		Title   string
+		Comment string
+	}{author, title, comment}); err != nil {
+		return comment
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	md "github.com/JohannesKaufmann/html-to-markdown"
+	"github.com/PuerkitoBio/goquery"
+	log "github.com/Sirupsen/logrus"
+)
+
+// replySeparators matches the line a mail client inserts just above quoted
+// history, in English and a couple of common localized forms. Everything
+// from the first match onward is discarded.
+var replySeparators = []*regexp.Regexp{
+	regexp.MustCompile(`(?mi)^On .{1,120} wrote:\s*$`),
+	regexp.MustCompile(`(?mi)^-----Original Message-----\s*$`),
+	regexp.MustCompile(`(?mi)^Le .{1,120} a écrit\s*:\s*$`),
+	regexp.MustCompile(`(?mi)^Am .{1,120} schrieb .{1,120}:\s*$`),
+}
+
+// htmlQuoteSelectors are the elements mail clients use to wrap quoted
+// history or signatures in HTML mail; they're dropped before conversion to
+// markdown.
+const htmlQuoteSelectors = "blockquote.gmail_quote, div.OutlookMessageHeader, hr#sig"
+
+// extractReplyBody picks the best available representation of an inbound
+// message and strips quoted history and signatures from it. It prefers
+// Mailgun's stripped-text/stripped-html fields, falling back to body-plain
+// when neither is present.
+func extractReplyBody(strippedText, strippedHTML, bodyPlain string) string {
+	switch {
+	case strippedText != "":
+		return stripPlainTextReply(strippedText)
+	case strippedHTML != "":
+		markdown, err := htmlToCleanedMarkdown(strippedHTML)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error": err.Error(),
+			}).Error("failed to convert stripped-html to markdown, falling back to body-plain")
+			return stripPlainTextReply(bodyPlain)
+		}
+		return stripPlainTextReply(markdown)
+	default:
+		return stripPlainTextReply(bodyPlain)
+	}
+}
+
+// stripPlainTextReply cuts a plain-text (or markdown) body at the first
+// reply separator, drops any quoted `> ` block that follows, and trims a
+// trailing `-- ` signature.
+func stripPlainTextReply(body string) string {
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+
+	cutAt := len(body)
+	for _, re := range replySeparators {
+		if loc := re.FindStringIndex(body); loc != nil && loc[0] < cutAt {
+			cutAt = loc[0]
+		}
+	}
+	body = body[:cutAt]
+
+	lines := strings.Split(body, "\n")
+	kept := lines[:0]
+	inQuoteBlock := false
+	for i, line := range lines {
+		isQuoteLine := strings.HasPrefix(strings.TrimLeft(line, " "), "> ")
+		precededByBlank := i == 0 || strings.TrimSpace(lines[i-1]) == ""
+		if isQuoteLine && (inQuoteBlock || precededByBlank) {
+			inQuoteBlock = true
+			continue
+		}
+		if strings.TrimSpace(line) != "" {
+			inQuoteBlock = false
+		}
+		kept = append(kept, line)
+	}
+	body = strings.Join(kept, "\n")
+
+	if idx := strings.Index(body, "\n-- \n"); idx >= 0 {
+		body = body[:idx]
+	} else if strings.HasPrefix(body, "-- \n") {
+		body = ""
+	}
+
+	return strings.TrimSpace(body)
+}
+
+// htmlToCleanedMarkdown removes quoted-history/signature markup from an
+// HTML mail body and converts what's left to markdown.
+func htmlToCleanedMarkdown(htmlBody string) (string, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(htmlBody))
+	if err != nil {
+		return "", fmt.Errorf("parse html body: %w", err)
+	}
+	doc.Find(htmlQuoteSelectors).Remove()
+
+	cleaned, err := doc.Html()
+	if err != nil {
+		return "", fmt.Errorf("render cleaned html: %w", err)
+	}
+
+	converter := md.NewConverter("", true, nil)
+	markdown, err := converter.ConvertString(cleaned)
+	if err != nil {
+		return "", fmt.Errorf("convert html to markdown: %w", err)
+	}
+	return markdown, nil
+}
+
+// wrapWithOriginal appends the untouched original message inside a
+// collapsed <details> block after the stripped comment body, so reviewers
+// can still see the full quoted thread if they need it.
+func wrapWithOriginal(author, stripped, original string) string {
+	original = strings.TrimSpace(original)
+	if original == "" || original == strings.TrimSpace(stripped) {
+		return stripped
+	}
+
+	return fmt.Sprintf(
+		"%s\n\n<details>\n<summary>Original message from %s</summary>\n\n%s\n\n</details>",
+		stripped, author, original,
+	)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStripPlainTextReplySeparators(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+	}{
+		{"english", "Reply text\n\nOn Mon, Jan 5, 2026 at 1:00 PM, Alice <alice@example.com> wrote:\n> quoted history"},
+		{"original message", "Reply text\n\n-----Original Message-----\nFrom: Alice\nquoted history"},
+		{"french", "Reply text\n\nLe 5 janv. 2026 à 13:00, Alice a écrit :\n> quoted history"},
+		{"german", "Reply text\n\nAm 05.01.2026 um 13:00 schrieb Alice:\n> quoted history"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := stripPlainTextReply(c.body)
+			if got != "Reply text" {
+				t.Errorf("stripPlainTextReply(%q) = %q, want %q", c.body, got, "Reply text")
+			}
+		})
+	}
+}
+
+func TestStripPlainTextReplySignature(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"signature mid-body", "Reply text\n-- \nAlice\nExample Corp", "Reply text"},
+		{"signature at start", "-- \nAlice\nExample Corp", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := stripPlainTextReply(c.body)
+			if got != c.want {
+				t.Errorf("stripPlainTextReply(%q) = %q, want %q", c.body, got, c.want)
+			}
+		})
+	}
+}
+
+func TestStripPlainTextReplyKeepsUnprecededQuoteLine(t *testing.T) {
+	body := "Reply text\n> not actually quoted, just a line starting with '> '\nmore reply text"
+
+	got := stripPlainTextReply(body)
+	if got != body {
+		t.Errorf("stripPlainTextReply(%q) = %q, want body unchanged since the '> ' line isn't preceded by a blank line", body, got)
+	}
+}
+
+func TestStripPlainTextReplyDropsBlockPrecededByBlankLine(t *testing.T) {
+	body := "Reply text\n\n> quoted first line\n> quoted second line\nmore reply text"
+
+	got := stripPlainTextReply(body)
+	want := "Reply text\n\nmore reply text"
+	if got != want {
+		t.Errorf("stripPlainTextReply(%q) = %q, want %q", body, got, want)
+	}
+}
+
+func TestHTMLToCleanedMarkdownStripsGmailQuote(t *testing.T) {
+	html := `<div>Reply text</div><blockquote class="gmail_quote">Quoted history</blockquote>`
+
+	markdown, err := htmlToCleanedMarkdown(html)
+	if err != nil {
+		t.Fatalf("htmlToCleanedMarkdown returned error: %v", err)
+	}
+	if strings.Contains(markdown, "Quoted history") {
+		t.Errorf("htmlToCleanedMarkdown(%q) = %q, want blockquote.gmail_quote contents removed", html, markdown)
+	}
+	if !strings.Contains(markdown, "Reply text") {
+		t.Errorf("htmlToCleanedMarkdown(%q) = %q, want reply text preserved", html, markdown)
+	}
+}
+
+func TestExtractReplyBodyPrefersStrippedText(t *testing.T) {
+	got := extractReplyBody("stripped text body", "<p>stripped html body</p>", "body-plain fallback")
+	if got != "stripped text body" {
+		t.Errorf("extractReplyBody() = %q, want stripped-text to win", got)
+	}
+}
+
+func TestExtractReplyBodyFallsBackToBodyPlain(t *testing.T) {
+	got := extractReplyBody("", "", "Reply text\n\nOn Mon wrote:\n> quoted")
+	if got != "Reply text" {
+		t.Errorf("extractReplyBody() = %q, want body-plain to be used and stripped", got)
+	}
+}
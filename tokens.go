@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// replyAddressPrefix is prepended to the signed token to build the
+// Reply-To address we hand out on outbound mail, e.g.
+// "reply+<token>@example.com".
+const replyAddressPrefix = "reply+"
+
+// makeReplyToken builds a signed token identifying an owner/repo/issue
+// triple. The token is self-contained: verifying it requires only the
+// shared secret, not a lookup in rkv.
+func makeReplyToken(secret, owner, repo string, issueNum int) string {
+	payload := fmt.Sprintf("%s|%s|%d", owner, repo, issueNum)
+	sig := base64.RawURLEncoding.EncodeToString(signPayload(secret, payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload + "|" + sig))
+}
+
+// parseReplyToken reverses makeReplyToken, verifying the HMAC before
+// returning the owner/repo/issue it encodes.
+func parseReplyToken(secret, token string) (owner, repo string, issueNum int, err error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("decode reply token: %w", err)
+	}
+
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 4 {
+		return "", "", 0, fmt.Errorf("malformed reply token")
+	}
+	owner, repo, issueStr, sig := parts[0], parts[1], parts[2], parts[3]
+
+	issueNum, err = strconv.Atoi(issueStr)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("reply token has non-numeric issue: %w", err)
+	}
+
+	payload := owner + "|" + repo + "|" + issueStr
+	expected := base64.RawURLEncoding.EncodeToString(signPayload(secret, payload))
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return "", "", 0, fmt.Errorf("reply token signature mismatch")
+	}
+
+	return owner, repo, issueNum, nil
+}
+
+func signPayload(secret, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// domainOf returns the domain half of an email address, stripping any
+// "Name <...>" wrapper first. It's used to default the reply-token domain
+// to smtp_from's domain under --transport imap+smtp.
+func domainOf(address string) string {
+	if lt := strings.LastIndex(address, "<"); lt >= 0 {
+		address = strings.TrimSuffix(address[lt+1:], ">")
+	}
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return ""
+	}
+	return address[at+1:]
+}
+
+// replyAddress returns the Reply-To address we ask recipients to reply to,
+// e.g. "reply+<token>@mg.example.com".
+func replyAddress(secret, domain, owner, repo string, issueNum int) string {
+	token := makeReplyToken(secret, owner, repo, issueNum)
+	return replyAddressPrefix + token + "@" + domain
+}
+
+// extractReplyToken pulls the token out of a "reply+<token>@domain"
+// address, as found in a To/Delivered-To header.
+func extractReplyToken(address string) (token string, ok bool) {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return "", false
+	}
+	local := address[:at]
+	// addresses may arrive as "Name <reply+token@domain>"
+	if lt := strings.LastIndex(local, "<"); lt >= 0 {
+		local = local[lt+1:]
+	}
+	if !strings.HasPrefix(local, replyAddressPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(local, replyAddressPrefix), true
+}
+
+// extractReplyTokenFromReferences scans a References header for any
+// "<reply+token@domain>" message id, for clients that drop our Reply-To
+// address from later replies in a thread but keep citing it in References.
+func extractReplyTokenFromReferences(references, domain string) (token string, ok bool) {
+	for _, id := range strings.Fields(references) {
+		id = strings.Trim(id, "<>")
+		if t, found := extractReplyToken(id); found && strings.HasSuffix(id, "@"+domain) {
+			return t, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestMakeAndParseReplyToken(t *testing.T) {
+	token := makeReplyToken("secret", "usegalaxy-eu", "issues", 42)
+
+	owner, repo, issueNum, err := parseReplyToken("secret", token)
+	if err != nil {
+		t.Fatalf("parseReplyToken returned error: %v", err)
+	}
+	if owner != "usegalaxy-eu" || repo != "issues" || issueNum != 42 {
+		t.Fatalf("got owner=%q repo=%q issueNum=%d, want usegalaxy-eu/issues#42", owner, repo, issueNum)
+	}
+}
+
+func TestParseReplyTokenWrongSecret(t *testing.T) {
+	token := makeReplyToken("secret", "usegalaxy-eu", "issues", 42)
+
+	if _, _, _, err := parseReplyToken("other-secret", token); err == nil {
+		t.Fatal("expected signature mismatch error, got nil")
+	}
+}
+
+func TestParseReplyTokenTamperedPayload(t *testing.T) {
+	token := makeReplyToken("secret", "usegalaxy-eu", "issues", 42)
+
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		t.Fatalf("failed to decode token for tampering: %v", err)
+	}
+	tampered := base64.RawURLEncoding.EncodeToString([]byte(strings.Replace(string(raw), "|42|", "|99|", 1)))
+
+	if _, _, _, err := parseReplyToken("secret", tampered); err == nil {
+		t.Fatal("expected signature mismatch error for tampered issue number, got nil")
+	}
+}
+
+func TestParseReplyTokenMalformed(t *testing.T) {
+	cases := []string{
+		"",
+		"not-base64!!!",
+		base64.RawURLEncoding.EncodeToString([]byte("only|three|parts")),
+	}
+
+	for _, token := range cases {
+		if _, _, _, err := parseReplyToken("secret", token); err == nil {
+			t.Errorf("parseReplyToken(%q): expected error, got nil", token)
+		}
+	}
+}
+
+func TestExtractReplyToken(t *testing.T) {
+	cases := []struct {
+		name    string
+		address string
+		want    string
+		wantOk  bool
+	}{
+		{"plain address", "reply+abc123@mg.example.com", "abc123", true},
+		{"named address", "Some Issue <reply+abc123@mg.example.com>", "abc123", true},
+		{"missing prefix", "bugs@usegalaxy.eu", "", false},
+		{"no at sign", "reply+abc123", "", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			token, ok := extractReplyToken(c.address)
+			if ok != c.wantOk || token != c.want {
+				t.Errorf("extractReplyToken(%q) = (%q, %v), want (%q, %v)", c.address, token, ok, c.want, c.wantOk)
+			}
+		})
+	}
+}
+
+func TestExtractReplyTokenFromReferences(t *testing.T) {
+	references := "<other-id@elsewhere.com> <reply+abc123@mg.example.com>"
+
+	token, ok := extractReplyTokenFromReferences(references, "mg.example.com")
+	if !ok || token != "abc123" {
+		t.Fatalf("extractReplyTokenFromReferences() = (%q, %v), want (\"abc123\", true)", token, ok)
+	}
+
+	if _, ok := extractReplyTokenFromReferences(references, "other-domain.com"); ok {
+		t.Fatal("expected no match for a domain that isn't referenced")
+	}
+}
+
+func TestDomainOf(t *testing.T) {
+	cases := []struct {
+		name    string
+		address string
+		want    string
+	}{
+		{"plain address", "bugs@usegalaxy.eu", "usegalaxy.eu"},
+		{"named address", "Support <support@usegalaxy.eu>", "usegalaxy.eu"},
+		{"no at sign", "not-an-address", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := domainOf(c.address); got != c.want {
+				t.Errorf("domainOf(%q) = %q, want %q", c.address, got, c.want)
+			}
+		})
+	}
+}
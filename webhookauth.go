@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/patrickmn/go-cache"
+)
+
+// mailgunReplayWindow bounds how stale a Mailgun webhook timestamp may be
+// before it's rejected; mailgunReplayTTL is how long we remember a token
+// to reject a replay of the same signed request.
+const mailgunReplayWindow = 5 * time.Minute
+const mailgunReplayTTL = 15 * time.Minute
+
+// verifyGitHubSignature checks the "sha256=<hex>" value of the
+// X-Hub-Signature-256 header against an HMAC-SHA256 of the raw request
+// body, keyed by the configured webhook secret.
+func verifyGitHubSignature(secret string, body []byte, signatureHeader string) bool {
+	if secret == "" || signatureHeader == "" {
+		return false
+	}
+
+	const prefix = "sha256="
+	if len(signatureHeader) <= len(prefix) || signatureHeader[:len(prefix)] != prefix {
+		return false
+	}
+	got, err := hex.DecodeString(signatureHeader[len(prefix):])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	want := mac.Sum(nil)
+
+	return hmac.Equal(got, want)
+}
+
+// verifyMailgunSignature reimplements Mailgun's recommended webhook check:
+// HMAC-SHA256 of timestamp+token keyed by the API key, compared to the
+// signature form field. It additionally rejects stale timestamps and
+// replayed tokens, tracked in replayCache.
+func verifyMailgunSignature(apiKey, timestamp, token, signature string, replayCache *cache.Cache) bool {
+	if apiKey == "" || timestamp == "" || token == "" || signature == "" {
+		return false
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > mailgunReplayWindow || age < -mailgunReplayWindow {
+		return false
+	}
+
+	if _, seen := replayCache.Get(token); seen {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(apiKey))
+	mac.Write([]byte(timestamp + token))
+	want := hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(signature), []byte(want)) {
+		return false
+	}
+
+	replayCache.Set(token, true, mailgunReplayTTL)
+	return true
+}
+
+// rejectUnauthorized logs the offending remote and the reason for the
+// rejection; the caller writes the 401 response.
+func rejectUnauthorized(remoteAddr, reason string) {
+	log.WithFields(log.Fields{
+		"remote": remoteAddr,
+		"reason": reason,
+	}).Error("rejected unauthenticated webhook request")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+func githubSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyGitHubSignature(t *testing.T) {
+	body := []byte(`{"action":"created"}`)
+	secret := "gh-secret"
+
+	if !verifyGitHubSignature(secret, body, githubSignature(secret, body)) {
+		t.Fatal("expected a correctly signed request to verify")
+	}
+}
+
+func TestVerifyGitHubSignatureRejectsWrongSecret(t *testing.T) {
+	body := []byte(`{"action":"created"}`)
+
+	if verifyGitHubSignature("gh-secret", body, githubSignature("other-secret", body)) {
+		t.Fatal("expected signature from a different secret to be rejected")
+	}
+}
+
+func TestVerifyGitHubSignatureRejectsTamperedBody(t *testing.T) {
+	secret := "gh-secret"
+	body := []byte(`{"action":"created"}`)
+	sig := githubSignature(secret, body)
+
+	if verifyGitHubSignature(secret, []byte(`{"action":"deleted"}`), sig) {
+		t.Fatal("expected signature over the original body to not match a tampered body")
+	}
+}
+
+func TestVerifyGitHubSignatureRejectsMissingValues(t *testing.T) {
+	body := []byte(`{}`)
+
+	if verifyGitHubSignature("", body, githubSignature("gh-secret", body)) {
+		t.Fatal("expected an empty secret to be rejected")
+	}
+	if verifyGitHubSignature("gh-secret", body, "") {
+		t.Fatal("expected an empty signature header to be rejected")
+	}
+	if verifyGitHubSignature("gh-secret", body, "not-prefixed-with-sha256=") {
+		t.Fatal("expected a malformed signature header to be rejected")
+	}
+}
+
+func mailgunSignature(apiKey, timestamp, token string) string {
+	mac := hmac.New(sha256.New, []byte(apiKey))
+	mac.Write([]byte(timestamp + token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyMailgunSignature(t *testing.T) {
+	apiKey := "mg-key"
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	token := "token-1"
+	replayCache := cache.New(mailgunReplayTTL, time.Minute)
+
+	if !verifyMailgunSignature(apiKey, timestamp, token, mailgunSignature(apiKey, timestamp, token), replayCache) {
+		t.Fatal("expected a correctly signed, fresh request to verify")
+	}
+}
+
+func TestVerifyMailgunSignatureRejectsReplay(t *testing.T) {
+	apiKey := "mg-key"
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	token := "token-1"
+	sig := mailgunSignature(apiKey, timestamp, token)
+	replayCache := cache.New(mailgunReplayTTL, time.Minute)
+
+	if !verifyMailgunSignature(apiKey, timestamp, token, sig, replayCache) {
+		t.Fatal("expected the first use of a token to verify")
+	}
+	if verifyMailgunSignature(apiKey, timestamp, token, sig, replayCache) {
+		t.Fatal("expected a replayed token to be rejected")
+	}
+}
+
+func TestVerifyMailgunSignatureRejectsStaleTimestamp(t *testing.T) {
+	apiKey := "mg-key"
+	timestamp := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	token := "token-1"
+	replayCache := cache.New(mailgunReplayTTL, time.Minute)
+
+	if verifyMailgunSignature(apiKey, timestamp, token, mailgunSignature(apiKey, timestamp, token), replayCache) {
+		t.Fatal("expected a timestamp outside the replay window to be rejected")
+	}
+}
+
+func TestVerifyMailgunSignatureRejectsTamperedSignature(t *testing.T) {
+	apiKey := "mg-key"
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	token := "token-1"
+	replayCache := cache.New(mailgunReplayTTL, time.Minute)
+
+	if verifyMailgunSignature(apiKey, timestamp, token, mailgunSignature("wrong-key", timestamp, token), replayCache) {
+		t.Fatal("expected a signature computed with the wrong key to be rejected")
+	}
+}